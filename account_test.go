@@ -0,0 +1,100 @@
+package main
+
+import "testing"
+
+func TestSaveAuthAccountConflict(t *testing.T) {
+	store := newFakeAccountStore()
+
+	acc := AuthAccount{Email: "a@b.com"}
+	ok, err := SaveAuthAccount(acc, store)
+	if err != nil || !ok {
+		t.Fatalf("initial save: ok=%v, err=%v", ok, err)
+	}
+
+	// Simulate a concurrent writer that already bumped the version past
+	// what our stale copy of acc thinks it is
+	stored, _ := store.Get("a@b.com")
+	stored.Version++
+	store.Put(stored)
+
+	ok, err = SaveAuthAccount(acc, store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatal("expected the stale save to be rejected, but it was applied")
+	}
+}
+
+func TestUpdateAuthAccountRetriesOnConflict(t *testing.T) {
+	store := newFakeAccountStore()
+	store.Put(AuthAccount{Email: "a@b.com"})
+
+	calls := 0
+	_, err := updateAuthAccount(store, "a@b.com", func(acc *AuthAccount) error {
+		calls++
+		if calls == 1 {
+			// Race a concurrent writer in between our fetch and our save
+			concurrent, _ := store.Get("a@b.com")
+			concurrent.Version++
+			store.Put(concurrent)
+		}
+		acc.SetKey(ApiKey{DeviceName: "phone"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls < 2 {
+		t.Fatalf("expected the conflict to trigger a retry, only called %d times", calls)
+	}
+
+	acc, err := store.Get("a@b.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acc.KeyForDevice("phone") == nil {
+		t.Fatal("retried update was not persisted")
+	}
+}
+
+// TestRevokeDoesNotResurrectAgainstConcurrentAuth guards the scenario the
+// chunk0-1 review caught: Auth's best-effort LastUsedAt bump reads the
+// account before a concurrent RevokeApiKey removes a key, and must not be
+// allowed to win the race and resurrect it
+func TestRevokeDoesNotResurrectAgainstConcurrentAuth(t *testing.T) {
+	store := newFakeAccountStore()
+	store.Put(AuthAccount{
+		Email:   "a@b.com",
+		ApiKeys: []ApiKey{{DeviceName: "phone", Key: "k1"}},
+	})
+
+	// Auth fetches the account before the revoke happens...
+	authSnapshot, err := FetchAuthAccount("a@b.com", store)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// ...then RevokeApiKey runs to completion first...
+	_, err = updateAuthAccount(store, "a@b.com", func(acc *AuthAccount) error {
+		acc.RemoveKeyForDevice("phone")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// ...and only then does Auth's stale save land, carrying a LastUsedAt
+	// bump for the key it read before the revoke. It must lose the race
+	// instead of overwriting the revoke
+	authSnapshot.ApiKeys[0].LastUsedAt = authSnapshot.ApiKeys[0].CreatedAt
+	SaveAuthAccount(authSnapshot, store)
+
+	acc, err := store.Get("a@b.com")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if acc.KeyForDevice("phone") != nil {
+		t.Fatal("revoked key was resurrected by a stale concurrent save")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// How long an activation token stays valid before ActivateApiKey rejects it
+// and the sweeper is free to reclaim it
+const activationTTL = 24 * time.Hour
+
+// activationRecord is what actually gets persisted for a pending
+// activation. The raw token itself is never stored, only its SHA-256 hash
+// (also used as the record's key), so a database leak doesn't hand out
+// usable activation links
+type activationRecord struct {
+	ApiKey    ApiKey    `json:"api_key"`
+	TokenHash string    `json:"token_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// KeyTTL is the duration ApiKey.ExpiresAt is set to, counted from
+	// activation rather than from the request: the client's requested TTL
+	// shouldn't burn down while the activation email is sitting unread
+	KeyTTL time.Duration `json:"key_ttl,omitempty"`
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// storeActivation persists a new activation record for apiKey, keyed by the
+// hash of token. keyTTL, if non-zero, is applied to ApiKey.ExpiresAt at
+// activation time rather than baked in now, so it counts down from when the
+// key actually becomes usable
+func storeActivation(store ActivationStore, token string, apiKey ApiKey, keyTTL time.Duration) error {
+	hash := hashToken(token)
+	now := time.Now()
+	rec := activationRecord{
+		ApiKey:    apiKey,
+		TokenHash: hash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(activationTTL),
+		KeyTTL:    keyTTL,
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return store.Put(hash, data)
+}
+
+// fetchActivation looks up the activation record matching token. The lookup
+// itself is by the token's SHA-256 hash rather than the raw token, so the
+// store never has to compare anything attacker-influenced; an expired
+// record is treated the same as a missing one
+func fetchActivation(store ActivationStore, token string) (activationRecord, error) {
+	hash := hashToken(token)
+	rec := activationRecord{}
+
+	data, err := store.Get(hash)
+	if err != nil {
+		return rec, err
+	}
+
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, err
+	}
+
+	if time.Now().After(rec.ExpiresAt) {
+		return rec, ErrNotFound
+	}
+
+	return rec, nil
+}
+
+// deleteActivation removes the activation record for token
+func deleteActivation(store ActivationStore, token string) error {
+	return store.Delete(hashToken(token))
+}
+
+// sweepExpiredActivations deletes every activation record whose ExpiresAt
+// has passed. Meant to be run periodically from a background goroutine
+func sweepExpiredActivations(store ActivationStore) error {
+	now := time.Now()
+
+	return store.ForEach(func(key string, data []byte) error {
+		rec := activationRecord{}
+		if err := json.Unmarshal(data, &rec); err != nil {
+			// Not an activation record we understand; leave it alone
+			// TODO: Handle the error?
+			return nil
+		}
+
+		if now.After(rec.ExpiresAt) {
+			return store.Delete(key)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// How many prior revisions of an account's data to retain in addition to
+// the current one. 0 (the default) disables history entirely
+var historyDepth = envInt("PADLOCK_HISTORY_DEPTH", 0)
+
+// dataEnvelope is what's actually stored for an account's data, wrapping
+// the opaque client blob with the metadata needed for optimistic
+// concurrency and history
+type dataEnvelope struct {
+	Revision  uint64    `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Body      []byte    `json:"body"`
+	// History lists the revisions retained prior to this one, most
+	// recent first, bounded by historyDepth
+	History []uint64 `json:"history,omitempty"`
+}
+
+// historyEntry is a single retained prior revision of an account's data,
+// stored under its own suffixed key so it doesn't bloat lookups of the
+// current revision
+type historyEntry struct {
+	Revision  uint64    `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Body      []byte    `json:"body"`
+}
+
+func historyKey(email string, revision uint64) string {
+	return fmt.Sprintf("%s#history#%d", email, revision)
+}
+
+func getEnvelope(store DataStore, email string) (dataEnvelope, error) {
+	env := dataEnvelope{}
+	data, err := store.Get(email)
+	if err != nil {
+		return env, err
+	}
+	return env, json.Unmarshal(data, &env)
+}
+
+func getHistoryEntry(store DataStore, email string, revision uint64) (historyEntry, error) {
+	entry := historyEntry{}
+	data, err := store.Get(historyKey(email, revision))
+	if err != nil {
+		return entry, err
+	}
+	return entry, json.Unmarshal(data, &entry)
+}
+
+func putHistoryEntry(store DataStore, email string, env dataEnvelope) error {
+	entry := historyEntry{Revision: env.Revision, UpdatedAt: env.UpdatedAt, Body: env.Body}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return store.Put(historyKey(email, env.Revision), data)
+}
+
+// recordRevision replaces the current envelope for email with a new one
+// wrapping body, atomically enforcing that current.Revision still matches
+// what's stored (via DataStore.PutIfRevision) so two concurrent writers
+// racing on the same revision can't both succeed. ok reports whether the
+// swap was applied; if false, a concurrent writer won the race and the
+// caller should treat the request as a conflict rather than retry blindly.
+// If historyDepth is configured, the outgoing revision is pushed onto the
+// history list and anything beyond historyDepth is pruned
+func recordRevision(store DataStore, email string, body []byte, current dataEnvelope, hadCurrent bool) (next dataEnvelope, ok bool, err error) {
+	next = dataEnvelope{
+		Revision:  current.Revision + 1,
+		UpdatedAt: time.Now(),
+		Body:      body,
+		History:   current.History,
+	}
+
+	if historyDepth > 0 && hadCurrent {
+		if err := putHistoryEntry(store, email, current); err != nil {
+			return next, false, err
+		}
+
+		next.History = append([]uint64{current.Revision}, current.History...)
+		if len(next.History) > historyDepth {
+			for _, rev := range next.History[historyDepth:] {
+				// TODO: Handle the error?
+				store.Delete(historyKey(email, rev))
+			}
+			next.History = next.History[:historyDepth]
+		}
+	}
+
+	data, err := json.Marshal(next)
+	if err != nil {
+		return next, false, err
+	}
+
+	ok, err = store.PutIfRevision(email, current.Revision, data)
+	return next, ok, err
+}
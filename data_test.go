@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestRecordRevisionConflict(t *testing.T) {
+	store := newFakeDataStore()
+
+	current, _, err := recordRevision(store, "a@b.com", []byte("v1"), dataEnvelope{}, false)
+	if err != nil || current.Revision != 1 {
+		t.Fatalf("initial write: got revision %d, err %v", current.Revision, err)
+	}
+
+	// Simulate a concurrent writer that already advanced the revision past
+	// what our stale "current" snapshot thinks it is
+	store.revs["a@b.com"] = 2
+
+	_, ok, err := recordRevision(store, "a@b.com", []byte("v2"), current, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ok {
+		t.Fatal("expected the stale write to be rejected, but it was applied")
+	}
+
+	env, err := getEnvelope(store, "a@b.com")
+	if err != nil || string(env.Body) != "v1" {
+		t.Fatalf("stale write clobbered the newer revision: got %q, err %v", env.Body, err)
+	}
+}
+
+func TestRecordRevisionSucceedsOnMatchingRevision(t *testing.T) {
+	store := newFakeDataStore()
+
+	current, ok, err := recordRevision(store, "a@b.com", []byte("v1"), dataEnvelope{}, false)
+	if err != nil || !ok {
+		t.Fatalf("initial write: ok=%v, err=%v", ok, err)
+	}
+
+	next, ok, err := recordRevision(store, "a@b.com", []byte("v2"), current, true)
+	if err != nil || !ok {
+		t.Fatalf("follow-up write: ok=%v, err=%v", ok, err)
+	}
+	if next.Revision != 2 {
+		t.Fatalf("expected revision 2, got %d", next.Revision)
+	}
+}
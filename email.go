@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// stripCRLF removes carriage returns and line feeds from a value that's
+// going straight into a raw header line, so a crafted "To"/"From" address
+// can't inject extra headers (e.g. a Bcc) into the message we hand-build
+func stripCRLF(s string) string {
+	s = strings.ReplaceAll(s, "\r", "")
+	return strings.ReplaceAll(s, "\n", "")
+}
+
+// EmailSender delivers an activation email as both a plain text and an HTML
+// part. Implementations are swapped via the PADLOCK_EMAIL_DRIVER env var so
+// the server can run without direct SMTP access, or without sending mail at
+// all during tests
+type EmailSender interface {
+	Send(rec string, subject string, textBody string, htmlBody string) error
+}
+
+// NewEmailSender picks an EmailSender based on PADLOCK_EMAIL_DRIVER ("smtp",
+// the default, "mailgun", or "noop")
+func NewEmailSender() (EmailSender, error) {
+	switch driver := os.Getenv("PADLOCK_EMAIL_DRIVER"); driver {
+	case "", "smtp":
+		return &SMTPSender{
+			User:     emailUser,
+			Password: emailPassword,
+			Server:   emailServer,
+			Port:     emailPort,
+		}, nil
+	case "mailgun":
+		domain := os.Getenv("PADLOCK_MAILGUN_DOMAIN")
+		key := os.Getenv("PADLOCK_MAILGUN_KEY")
+		if domain == "" || key == "" {
+			return nil, fmt.Errorf("padlock: PADLOCK_MAILGUN_DOMAIN and PADLOCK_MAILGUN_KEY are required for the mailgun email driver")
+		}
+		return &MailgunSender{Domain: domain, ApiKey: key}, nil
+	case "noop":
+		return &NoopSender{}, nil
+	default:
+		return nil, fmt.Errorf("padlock: unknown email driver %q", driver)
+	}
+}
+
+// SMTPSender sends mail through a plain SMTP relay, the way the server has
+// always done
+type SMTPSender struct {
+	User     string
+	Password string
+	Server   string
+	Port     string
+}
+
+func (s *SMTPSender) Send(rec string, subject string, textBody string, htmlBody string) error {
+	auth := smtp.PlainAuth("", s.User, s.Password, s.Server)
+	return smtp.SendMail(
+		s.Server+":"+s.Port,
+		auth,
+		s.User,
+		[]string{rec},
+		buildMimeMessage(s.User, rec, subject, textBody, htmlBody),
+	)
+}
+
+// MailgunSender sends mail through the Mailgun HTTP API, for deployments
+// that would rather not open an SMTP egress
+type MailgunSender struct {
+	Domain string
+	ApiKey string
+}
+
+func (s *MailgunSender) Send(rec string, subject string, textBody string, htmlBody string) error {
+	form := url.Values{}
+	form.Set("from", fmt.Sprintf("Padlock Cloud <noreply@%s>", s.Domain))
+	form.Set("to", rec)
+	form.Set("subject", subject)
+	form.Set("text", textBody)
+	form.Set("html", htmlBody)
+
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("https://api.mailgun.net/v3/%s/messages", s.Domain),
+		strings.NewReader(form.Encode()),
+	)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", s.ApiKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("padlock: mailgun request failed with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// NoopSender discards mail. Useful in tests and local development where no
+// email transport is configured
+type NoopSender struct{}
+
+func (s *NoopSender) Send(rec string, subject string, textBody string, htmlBody string) error {
+	return nil
+}
+
+// buildMimeMessage renders a multipart/alternative message with a text and
+// an html part plus the headers that, unlike the old bare "Subject:" + body
+// message, modern MTAs expect to see before they'll accept mail
+func buildMimeMessage(from string, to string, subject string, textBody string, htmlBody string) []byte {
+	from, to = stripCRLF(from), stripCRLF(to)
+
+	domain := emailServer
+	if parts := strings.SplitN(from, "@", 2); len(parts) == 2 {
+		domain = parts[1]
+	}
+	boundary := uuid()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", uuid(), domain)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", textBody)
+
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	fmt.Fprintf(&buf, "Content-Type: text/html; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&buf, "%s\r\n\r\n", htmlBody)
+
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+
+	return buf.Bytes()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripCRLF(t *testing.T) {
+	got := stripCRLF("a@b.com\r\nBcc: attacker@evil.com")
+	if strings.ContainsAny(got, "\r\n") {
+		t.Fatalf("stripCRLF left a newline in place: %q", got)
+	}
+}
+
+func TestBuildMimeMessageRejectsHeaderInjection(t *testing.T) {
+	msg := string(buildMimeMessage(
+		"noreply@example.com",
+		"victim@example.com\r\nBcc: attacker@evil.com",
+		"subject", "text", "<p>html</p>",
+	))
+
+	if strings.Contains(msg, "\nBcc:") {
+		t.Fatalf("crafted To address injected a header line:\n%s", msg)
+	}
+}
+
+func TestEmailRE(t *testing.T) {
+	valid := []string{"a@b.com", "first.last@sub.example.org"}
+	invalid := []string{"", "not-an-email", "a@b.com\r\nBcc: x@y.com", "a @b.com"}
+
+	for _, e := range valid {
+		if !emailRE.MatchString(e) {
+			t.Errorf("expected %q to be accepted", e)
+		}
+	}
+	for _, e := range invalid {
+		if emailRE.MatchString(e) {
+			t.Errorf("expected %q to be rejected", e)
+		}
+	}
+}
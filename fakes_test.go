@@ -0,0 +1,151 @@
+package main
+
+import (
+	"sync"
+)
+
+// fakeDataStore is an in-memory DataStore used by tests. Its PutIfRevision
+// mirrors the CAS semantics the leveldb/sql backends implement, so tests
+// can exercise recordRevision's conflict handling without a real backend
+type fakeDataStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	revs map[string]uint64
+}
+
+func newFakeDataStore() *fakeDataStore {
+	return &fakeDataStore{data: make(map[string][]byte), revs: make(map[string]uint64)}
+}
+
+func (s *fakeDataStore) Get(email string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.data[email]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *fakeDataStore) Put(email string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[email] = data
+	return nil
+}
+
+func (s *fakeDataStore) Delete(email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, email)
+	return nil
+}
+
+func (s *fakeDataStore) PutIfRevision(email string, expectedRevision uint64, data []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.revs[email] != expectedRevision {
+		return false, nil
+	}
+
+	s.data[email] = data
+	s.revs[email] = expectedRevision + 1
+	return true, nil
+}
+
+// fakeAccountStore is an in-memory AccountStore used by tests. Its
+// PutIfVersion mirrors the CAS semantics the leveldb/sql backends
+// implement, so tests can exercise SaveAuthAccount/updateAuthAccount's
+// conflict handling without a real backend
+type fakeAccountStore struct {
+	mu       sync.Mutex
+	accounts map[string]AuthAccount
+}
+
+func newFakeAccountStore() *fakeAccountStore {
+	return &fakeAccountStore{accounts: make(map[string]AuthAccount)}
+}
+
+func (s *fakeAccountStore) Get(email string) (AuthAccount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.accounts[email]
+	if !ok {
+		return AuthAccount{}, ErrNotFound
+	}
+	return acc, nil
+}
+
+func (s *fakeAccountStore) Put(acc AuthAccount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts[acc.Email] = acc
+	return nil
+}
+
+func (s *fakeAccountStore) PutIfVersion(acc AuthAccount, version uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.accounts[acc.Email].Version != version {
+		return false, nil
+	}
+
+	s.accounts[acc.Email] = acc
+	return true, nil
+}
+
+// fakeActivationStore is an in-memory ActivationStore used by tests
+type fakeActivationStore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newFakeActivationStore() *fakeActivationStore {
+	return &fakeActivationStore{data: make(map[string][]byte)}
+}
+
+func (s *fakeActivationStore) Get(token string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.data[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *fakeActivationStore) Put(token string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[token] = data
+	return nil
+}
+
+func (s *fakeActivationStore) Delete(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, token)
+	return nil
+}
+
+func (s *fakeActivationStore) ForEach(fn func(key string, data []byte) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for k, v := range s.data {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func main() {
+	log := logrus.New()
+	log.SetFormatter(&logrus.JSONFormatter{})
+
+	storage, err := NewStorage()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %s", err)
+	}
+	defer storage.Close()
+
+	sender, err := NewEmailSender()
+	if err != nil {
+		log.Fatalf("Failed to set up email sender: %s", err)
+	}
+
+	// Periodically sweep expired activation records and stale rate limiter
+	// entries out of memory
+	go func() {
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := sweepExpiredActivations(storage.Activations); err != nil {
+				log.WithError(err).Warn("failed to sweep expired activations")
+			}
+			sweepRateLimiters()
+		}
+	}()
+
+	addr := os.Getenv("PADLOCK_LISTEN_ADDR")
+	if addr == "" {
+		addr = ":3000"
+	}
+
+	server := NewServer(storage, sender, log)
+
+	log.WithField("addr", addr).Info("padlock-cloud listening")
+	log.Fatal(http.ListenAndServe(addr, server.Router()))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Counters and histograms exposed on /metrics. Route labels use the route
+// pattern (e.g. "/auth/:device_name"), not the literal request path, so
+// cardinality stays bounded
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "padlock_http_requests_total",
+		Help: "Total number of HTTP requests processed, by route, method and status",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "padlock_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests, by route and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	authFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "padlock_auth_failures_total",
+		Help: "Total number of failed authentication attempts",
+	})
+
+	keyActivationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "padlock_key_activations_total",
+		Help: "Total number of api keys activated",
+	})
+
+	dataReadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "padlock_data_reads_total",
+		Help: "Total number of successful data reads",
+	})
+
+	dataWritesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "padlock_data_writes_total",
+		Help: "Total number of successful data writes",
+	})
+)
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
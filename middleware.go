@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader is echoed back on every response so a client-reported
+// issue can be traced to a single log line
+const requestIDHeader = "X-Request-Id"
+
+// wrap turns a handlerFunc into an httprouter.Handle, tagging the request
+// with an id, logging the outcome and recording metrics for it. route is
+// the route pattern (not the literal path) so metrics stay low-cardinality
+func (s *Server) wrap(route string, h handlerFunc) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		reqID := uuid()
+		w.Header().Set(requestIDHeader, reqID)
+
+		status, body := h(w, req, ps)
+
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+
+		duration := time.Since(start)
+
+		s.Log.WithFields(logrus.Fields{
+			"request_id":  reqID,
+			"method":      req.Method,
+			"route":       route,
+			"status":      status,
+			"duration_ms": duration.Milliseconds(),
+		}).Info("handled request")
+
+		httpRequestsTotal.WithLabelValues(route, req.Method, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(route, req.Method).Observe(duration.Seconds())
+	}
+}
+
+// rateLimitKeyRequest throttles POST /auth by client IP and by the email
+// address being requested, so a single client (or a single target email
+// address) can't be used to spam activation emails
+func (s *Server) rateLimitKeyRequest(next handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+		req.ParseForm()
+
+		if !requestKeyLimitByIP.Allow(clientIP(req)) {
+			return http.StatusTooManyRequests, "Too many requests, please try again later"
+		}
+
+		if email := req.PostForm.Get("email"); email != "" && !requestKeyLimitByEmail.Allow(email) {
+			return http.StatusTooManyRequests, "Too many requests for this email address, please try again later"
+		}
+
+		return next(w, req, ps)
+	}
+}
+
+// rateLimitActivate throttles GET /activate/:token by client IP, to slow
+// down brute-force guessing of activation tokens
+func (s *Server) rateLimitActivate(next handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+		if !activateLimitByIP.Allow(clientIP(req)) {
+			return http.StatusTooManyRequests, "Too many requests, please try again later"
+		}
+
+		return next(w, req, ps)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Rate limit applied to POST /auth and GET /activate/:token, both per client
+// IP and (for /auth) per requested email address. Overridable via
+// PADLOCK_RATE_PER_MINUTE / PADLOCK_RATE_BURST so self-hosters with a lot of
+// legitimate traffic aren't locked out by the defaults
+var (
+	rateLimitPerMinute = envInt("PADLOCK_RATE_PER_MINUTE", 5)
+	rateLimitBurst     = envInt("PADLOCK_RATE_BURST", 5)
+
+	requestKeyLimitByIP    = newLimiterSet(rateLimitPerMinute, rateLimitBurst)
+	requestKeyLimitByEmail = newLimiterSet(rateLimitPerMinute, rateLimitBurst)
+	activateLimitByIP      = newLimiterSet(rateLimitPerMinute, rateLimitBurst)
+)
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+// limiterEntry pairs a rate.Limiter with the last time it was touched, so
+// stale entries (clients that made one request and never came back) can be
+// evicted instead of accumulating in the map forever
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// limiterIdleTTL is how long a per-key limiter can go unused before
+// sweepLimiters reclaims it
+const limiterIdleTTL = 1 * time.Hour
+
+// limiterSet hands out a token-bucket rate.Limiter per key (e.g. per IP or
+// per email address), creating one lazily the first time a key is seen
+type limiterSet struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	limit    rate.Limit
+	burst    int
+}
+
+func newLimiterSet(perMinute int, burst int) *limiterSet {
+	return &limiterSet{
+		limiters: make(map[string]*limiterEntry),
+		limit:    rate.Limit(float64(perMinute) / 60),
+		burst:    burst,
+	}
+}
+
+func (s *limiterSet) Allow(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(s.limit, s.burst)}
+		s.limiters[key] = e
+	}
+	e.lastUsed = time.Now()
+
+	return e.limiter.Allow()
+}
+
+// sweep drops any limiter that hasn't been touched in longer than maxAge, so
+// a flood of distinct keys (e.g. spoofed IPs) doesn't grow the map forever
+func (s *limiterSet) sweep(maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, e := range s.limiters {
+		if now.Sub(e.lastUsed) > maxAge {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+// sweepRateLimiters evicts stale entries from every limiterSet the server
+// keeps. Meant to be run periodically from a background goroutine, the same
+// way sweepExpiredActivations is
+func sweepRateLimiters() {
+	requestKeyLimitByIP.sweep(limiterIdleTTL)
+	requestKeyLimitByEmail.sweep(limiterIdleTTL)
+	activateLimitByIP.sweep(limiterIdleTTL)
+}
+
+// trustedProxies lists the IPs/CIDRs (set via PADLOCK_TRUSTED_PROXIES, comma
+// separated) allowed to set X-Forwarded-For. Without it, any client could
+// spoof the header and get a fresh rate-limit bucket on every request
+var trustedProxies = parseTrustedProxies(os.Getenv("PADLOCK_TRUSTED_PROXIES"))
+
+func parseTrustedProxies(csv string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(csv, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			if strings.Contains(part, ":") {
+				part += "/128"
+			} else {
+				part += "/32"
+			}
+		}
+		if _, ipnet, err := net.ParseCIDR(part); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+func isTrustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP extracts the address the rate limiters should key on. It only
+// honors X-Forwarded-For (set by the reverse proxy most self-hosted setups
+// run behind) when the immediate connection comes from a configured trusted
+// proxy; otherwise a client could spoof the header to dodge the limiter
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" && isTrustedProxy(host) {
+		return strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+
+	return host
+}
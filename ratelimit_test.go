@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClientIPIgnoresForwardedForFromUntrustedPeer(t *testing.T) {
+	old := trustedProxies
+	trustedProxies = nil
+	defer func() { trustedProxies = old }()
+
+	req := &http.Request{RemoteAddr: "203.0.113.5:1234", Header: http.Header{}}
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	if got := clientIP(req); got != "203.0.113.5" {
+		t.Fatalf("expected the spoofed header to be ignored, got %q", got)
+	}
+}
+
+func TestClientIPHonorsForwardedForFromTrustedProxy(t *testing.T) {
+	old := trustedProxies
+	trustedProxies = parseTrustedProxies("203.0.113.5/32")
+	defer func() { trustedProxies = old }()
+
+	req := &http.Request{RemoteAddr: "203.0.113.5:1234", Header: http.Header{}}
+	req.Header.Set("X-Forwarded-For", "198.51.100.9, 10.0.0.1")
+
+	if got := clientIP(req); got != "198.51.100.9" {
+		t.Fatalf("expected the forwarded address from a trusted proxy, got %q", got)
+	}
+}
+
+func TestLimiterSetSweepEvictsStaleEntries(t *testing.T) {
+	s := newLimiterSet(5, 5)
+	s.Allow("203.0.113.5")
+
+	s.limiters["203.0.113.5"].lastUsed = time.Now().Add(-2 * time.Hour)
+	s.sweep(time.Hour)
+
+	if len(s.limiters) != 0 {
+		t.Fatalf("expected the stale entry to be evicted, map has %d entries", len(s.limiters))
+	}
+}
+
+func TestLimiterSetSweepKeepsFreshEntries(t *testing.T) {
+	s := newLimiterSet(5, 5)
+	s.Allow("203.0.113.5")
+
+	s.sweep(time.Hour)
+
+	if len(s.limiters) != 1 {
+		t.Fatalf("expected the fresh entry to survive, map has %d entries", len(s.limiters))
+	}
+}
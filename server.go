@@ -1,17 +1,43 @@
 package main
 
-import "net/http"
-import "io/ioutil"
-import "crypto/rand"
-import "fmt"
-import "net/smtp"
-import "os"
-import "encoding/json"
-import "regexp"
-import "bytes"
-import "text/template"
-import "github.com/codegangsta/martini"
-import "github.com/syndtr/goleveldb/leveldb"
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// Scopes that can be granted to an api key. A key without any scopes is
+// treated as granting every scope, so that keys created before scoped
+// keys existed keep working.
+const (
+	ScopeDataRead   = "data:read"
+	ScopeDataWrite  = "data:write"
+	ScopeKeysManage = "keys:manage"
+)
+
+// Scopes requested for a new api key by default, if none are specified
+// explicitly in the activation request
+var defaultScopes = []string{ScopeDataRead, ScopeDataWrite}
+
+// emailRE is a deliberately permissive email format check: it's only here
+// to reject garbage (including CR/LF, which would otherwise flow straight
+// into the raw headers buildMimeMessage writes for the activation email),
+// not to fully validate deliverability
+var emailRE = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
 
 var (
 	// Settings for sending emails
@@ -21,8 +47,9 @@ var (
 	emailPassword = os.Getenv("PADLOCK_EMAIL_PASSWORD")
 	// Path to the leveldb database
 	dbPath = os.Getenv("PADLOCK_DB_PATH")
-	// Email template for api key activation email
-	actEmailTemp = template.Must(template.ParseFiles("templates/activate.txt"))
+	// Email templates for the api key activation email, text and html parts
+	actEmailTextTemp = template.Must(template.ParseFiles("templates/activate.txt"))
+	actEmailHTMLTemp = htmltemplate.Must(htmltemplate.ParseFiles("templates/activate.html"))
 )
 
 // RFC4122-compliant uuid generator
@@ -34,58 +61,40 @@ func uuid() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
-// Helper function for sending emails
-func sendMail(rec string, subject string, body string) error {
-	auth := smtp.PlainAuth(
-		"",
-		emailUser,
-		emailPassword,
-		emailServer,
-	)
-
-	message := fmt.Sprintf("Subject: %s\r\n\r\n%s", subject, body)
-	return smtp.SendMail(
-		emailServer+":"+emailPort,
-		auth,
-		emailUser,
-		[]string{rec},
-		[]byte(message),
-	)
-}
-
-// These are used so the different databases can be injected as services
-// into hanlder functions
-type DataDB struct {
-	*leveldb.DB
-}
-type AuthDB struct {
-	*leveldb.DB
-}
-type ActDB struct {
-	*leveldb.DB
+// A wrapper for an api key containing some meta info like the user and device name
+type ApiKey struct {
+	Email      string `json:"email"`
+	DeviceName string `json:"device_name"`
+	Key        string `json:"key"`
+	// Scopes this key is allowed to act within, e.g. "data:read". A key
+	// with no scopes is granted every scope (see HasScope)
+	Scopes     []string  `json:"scopes,omitempty"`
+	CreatedAt  time.Time `json:"created_at,omitempty"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty"`
+	// ExpiresAt is the zero time if this key never expires
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
 }
 
-// Service type for use in handler functions. Gets injectected by the InjectBody
-// middleware
-type RequestBody []byte
-
-// Middleware for reading the request body and injecting it as a RequestBody
-func InjectBody(res http.ResponseWriter, req *http.Request, c martini.Context) {
-	b, err := ioutil.ReadAll(req.Body)
-	rb := RequestBody(b)
+// Checks if this key is allowed to act within a given scope. A key with
+// no scopes recorded is treated as unrestricted, for keys that predate
+// scoped keys
+func (k *ApiKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return true
+	}
 
-	if err != nil {
-		http.Error(res, fmt.Sprintf("An error occured while reading the request body: %s", err), http.StatusInternalServerError)
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
 	}
 
-	c.Map(rb)
+	return false
 }
 
-// A wrapper for an api key containing some meta info like the user and device name
-type ApiKey struct {
-	Email      string `json:"email"`
-	DeviceName string `json:"device_name"`
-	Key        string `json:"key"`
+// Checks if this key has expired
+func (k *ApiKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
 }
 
 // A struct representing a user with a set of api keys
@@ -96,6 +105,9 @@ type AuthAccount struct {
 	// A set of api keys that can be used to access the data associated with this
 	// account
 	ApiKeys []ApiKey
+	// Version is bumped on every save and used by SaveAuthAccount to
+	// detect concurrent modifications (see updateAuthAccount)
+	Version uint64
 }
 
 // Fetches the ApiKey for a given device name. Returns nil if none is found
@@ -126,120 +138,222 @@ func (a *AuthAccount) SetKey(apiKey ApiKey) {
 	a.ApiKeys = append(a.ApiKeys, apiKey)
 }
 
-// Checks if a given api key is valid for this account
-func (a *AuthAccount) Validate(key string) bool {
+// Checks if a given api key is valid for this account and grants the
+// required scope. Returns the matching ApiKey so callers can update its
+// usage metadata
+func (a *AuthAccount) Validate(key string, requiredScope string) *ApiKey {
 	// Check if the account contains any ApiKey with that matches
 	// the given key
-	for _, apiKey := range a.ApiKeys {
+	for i, apiKey := range a.ApiKeys {
 		if apiKey.Key == key {
-			return true
+			if apiKey.Expired() || !apiKey.HasScope(requiredScope) {
+				return nil
+			}
+			return &a.ApiKeys[i]
 		}
 	}
 
-	return false
+	return nil
 }
 
-// Saves an AuthAccount instance to a given database
-func SaveAuthAccount(a AuthAccount, db *AuthDB) error {
-	key := []byte(a.Email)
-	data, err := json.Marshal(a)
-	if err != nil {
-		return err
-	}
-	return db.Put(key, data, nil)
+// Saves an AuthAccount instance to a given account store, using optimistic
+// concurrency so a save can't silently clobber a change made to the same
+// account in between a's being fetched and saved. ok reports whether the
+// save was applied; a false result with a nil error means a concurrent
+// writer updated the account first and a lost the race
+func SaveAuthAccount(a AuthAccount, store AccountStore) (bool, error) {
+	expected := a.Version
+	a.Version++
+	return store.PutIfVersion(a, expected)
 }
 
-// Fetches an AuthAccount with the given email from the given database
-func FetchAuthAccount(email string, db *AuthDB) (AuthAccount, error) {
-	key := []byte(email)
-	data, err := db.Get(key, nil)
-	acc := AuthAccount{}
+// Fetches an AuthAccount with the given email from the given account store
+func FetchAuthAccount(email string, store AccountStore) (AuthAccount, error) {
+	return store.Get(email)
+}
 
-	if err != nil {
-		return acc, err
-	}
+// errKeyNotFound is returned by updateAuthAccount's mutate callback to
+// signal that the api key it was looking for isn't registered
+var errKeyNotFound = errors.New("padlock: no api key found for that device")
+
+// maxAccountCASRetries bounds how many times updateAuthAccount will
+// re-fetch and retry a mutation before giving up, so a hot account can't
+// spin forever under contention
+const maxAccountCASRetries = 10
+
+// updateAuthAccount fetches the account for email (or starts from a fresh
+// one if it doesn't exist yet), applies mutate to it and saves the result
+// back using optimistic concurrency, re-fetching and retrying the whole
+// cycle if a concurrent writer (e.g. Auth bumping LastUsedAt, or another
+// call to updateAuthAccount) won the race in between. This is how
+// ActivateApiKey, RevokeApiKey and RotateApiKey apply their changes
+// safely instead of blindly overwriting whatever's currently stored
+func updateAuthAccount(store AccountStore, email string, mutate func(*AuthAccount) error) (AuthAccount, error) {
+	for i := 0; i < maxAccountCASRetries; i++ {
+		acc, err := FetchAuthAccount(email, store)
+		if err != nil && err != ErrNotFound {
+			return acc, err
+		}
+		if err == ErrNotFound {
+			acc = AuthAccount{Email: email}
+		}
 
-	err = json.Unmarshal(data, &acc)
+		if err := mutate(&acc); err != nil {
+			return acc, err
+		}
 
-	if err != nil {
-		return acc, err
+		ok, err := SaveAuthAccount(acc, store)
+		if err != nil {
+			return acc, err
+		}
+		if ok {
+			return acc, nil
+		}
 	}
 
-	return acc, nil
+	return AuthAccount{}, fmt.Errorf("padlock: too much contention updating account %s", email)
+}
+
+// Server holds the dependencies every handler needs. It replaces the
+// per-handler martini service injection with plain method receivers, now
+// that handlers are wired up through httprouter instead
+type Server struct {
+	Storage *Storage
+	Sender  EmailSender
+	Log     *logrus.Logger
+}
+
+// NewServer wires up a Server ready to have its Router mounted
+func NewServer(storage *Storage, sender EmailSender, log *logrus.Logger) *Server {
+	return &Server{Storage: storage, Sender: sender, Log: log}
+}
+
+// handlerFunc is the signature every route handler is written against. It
+// mirrors httprouter.Handle but returns the response instead of writing it
+// directly, so the wrap/Auth/rate-limit middleware can observe and log the
+// outcome uniformly
+type handlerFunc func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string)
+
+// accountCtxKey is the context.Context key Auth uses to pass the
+// authenticated AuthAccount down to the wrapped handler
+type accountCtxKey struct{}
+
+func accountFromContext(req *http.Request) AuthAccount {
+	acc, _ := req.Context().Value(accountCtxKey{}).(AuthAccount)
+	return acc
 }
 
-// Authentication middleware. Checks if a valid authentication header is provided
-// and, in case of a successful authentication, injects the corresponding AuthAccount
-// instance into andy subsequent handlers
-func Auth(req *http.Request, w http.ResponseWriter, db *AuthDB, c martini.Context) {
+// Auth wraps next with a check that a valid authentication header is
+// present and that the key used grants the required scope. On success the
+// corresponding AuthAccount is attached to the request context before next
+// runs
+func (s *Server) Auth(requiredScope string, next handlerFunc) handlerFunc {
 	re := regexp.MustCompile("ApiKey (?P<email>.+):(?P<key>.+)")
-	authHeader := req.Header.Get("Authorization")
 
-	// Check if the Authorization header exists and is well formed
-	if !re.MatchString(authHeader) {
-		http.Error(w, "No valid authorization header provided", http.StatusUnauthorized)
-		return
-	}
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+		authHeader := req.Header.Get("Authorization")
 
-	// Extract email and api key from Authorization header
-	matches := re.FindStringSubmatch(authHeader)
-	email, key := matches[1], matches[2]
+		// Check if the Authorization header exists and is well formed
+		if !re.MatchString(authHeader) {
+			authFailuresTotal.Inc()
+			return http.StatusUnauthorized, "No valid authorization header provided"
+		}
 
-	// Fetch account for the given email address
-	authAccount, err := FetchAuthAccount(email, db)
+		// Extract email and api key from Authorization header
+		matches := re.FindStringSubmatch(authHeader)
+		email, key := matches[1], matches[2]
 
-	if err != nil {
-		if err == leveldb.ErrNotFound {
-			http.Error(w, fmt.Sprintf("User %s does not exists", email), http.StatusUnauthorized)
-		} else {
-			http.Error(w, fmt.Sprintf("Database error: %s", err), http.StatusInternalServerError)
+		// Fetch account for the given email address
+		authAccount, err := FetchAuthAccount(email, s.Storage.Accounts)
+
+		if err != nil {
+			authFailuresTotal.Inc()
+			if err == ErrNotFound {
+				return http.StatusUnauthorized, fmt.Sprintf("User %s does not exists", email)
+			}
+			return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
 		}
-		return
-	}
 
-	// Check if the provide api key is valid
-	if !authAccount.Validate(key) {
-		http.Error(w, "The provided key was not valid", http.StatusUnauthorized)
-		return
-	}
+		// Check if the provided api key is valid and grants the required scope
+		apiKey := authAccount.Validate(key, requiredScope)
+		if apiKey == nil {
+			authFailuresTotal.Inc()
+			return http.StatusUnauthorized, "The provided key was not valid"
+		}
 
-	c.Map(authAccount)
+		// Record key usage and persist it. This is best-effort: on a high
+		// traffic key it will often race with another request's own
+		// LastUsedAt bump (or with a revoke/rotate), in which case the
+		// save is simply skipped rather than retried, since losing a
+		// usage timestamp update isn't worth holding up the request for
+		apiKey.LastUsedAt = time.Now()
+		// TODO: Handle the error?
+		SaveAuthAccount(authAccount, s.Storage.Accounts)
+
+		ctx := context.WithValue(req.Context(), accountCtxKey{}, authAccount)
+		return next(w, req.WithContext(ctx), ps)
+	}
 }
 
 // Handler function for requesting an api key. Generates a key-token pair and stores them.
 // The token can later be used to activate the api key. An email is sent to the corresponding
 // email address with an activation url
-func RequestApiKey(req *http.Request, actDb *ActDB, w http.ResponseWriter) (int, string) {
+func (s *Server) RequestApiKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
 	req.ParseForm()
-	// TODO: Add validation
 	email, deviceName := req.PostForm.Get("email"), req.PostForm.Get("device_name")
 
+	if !emailRE.MatchString(email) {
+		return http.StatusBadRequest, "A valid email address is required"
+	}
+
+	scopes := req.PostForm["scopes"]
+	if len(scopes) == 0 {
+		scopes = defaultScopes
+	}
+
+	// A key never expires unless the client asks for a TTL. The TTL is
+	// applied to ExpiresAt at activation time (see ActivateApiKey), not
+	// here, so it doesn't burn down while the activation email sits unread
+	var keyTTL time.Duration
+	if expiresIn := req.PostForm.Get("expires_in"); expiresIn != "" {
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil || d <= 0 {
+			return http.StatusBadRequest, `expires_in must be a positive duration, e.g. "720h"`
+		}
+		keyTTL = d
+	}
+
 	// Generate key-token pair
 	key := uuid()
 	token := uuid()
 	apiKey := ApiKey{
-		email,
-		deviceName,
-		key,
+		Email:      email,
+		DeviceName: deviceName,
+		Key:        key,
+		Scopes:     scopes,
+		CreatedAt:  time.Now(),
 	}
 
-	// Store key-token pair
+	// Store key-token pair. Only a hash of the token is persisted
 	// TODO: Handle the error?
+	storeActivation(s.Storage.Activations, token, apiKey, keyTTL)
 	data, _ := json.Marshal(apiKey)
-	// TODO: Handle the error
-	actDb.Put([]byte(token), data, nil)
 
-	// Render email
-	var buff bytes.Buffer
-	actEmailTemp.Execute(&buff, map[string]string{
+	// Render the text and html parts of the activation email
+	templateData := map[string]string{
 		"email":           apiKey.Email,
 		"device_name":     apiKey.DeviceName,
 		"activation_link": fmt.Sprintf("http://%s/activate/%s", req.Host, token),
-	})
-	body := buff.String()
+	}
+
+	var textBuff, htmlBuff bytes.Buffer
+	// TODO: Handle the error?
+	actEmailTextTemp.Execute(&textBuff, templateData)
+	// TODO: Handle the error?
+	actEmailHTMLTemp.Execute(&htmlBuff, templateData)
 
 	// Send email with activation link
-	go sendMail(email, "Api key activation", body)
+	go s.Sender.Send(email, "Api key activation", textBuff.String(), htmlBuff.String())
 
 	// We're returning a JSON serialization of the ApiKey object
 	w.Header().Set("Content-Type", "application/json")
@@ -248,58 +362,56 @@ func RequestApiKey(req *http.Request, actDb *ActDB, w http.ResponseWriter) (int,
 }
 
 // Hander function for activating a given api key
-func ActivateApiKey(params martini.Params, actDB *ActDB, authDB *AuthDB) (int, string) {
-	token := params["token"]
+func (s *Server) ActivateApiKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	token := ps.ByName("token")
 
-	// Let's check if an unactivate api key exists for this token. If not,
-	// the token is obviously not valid
-	data, err := actDB.Get([]byte(token), nil)
+	// Let's check if an unactivated, unexpired api key exists for this
+	// token. If not, the token is obviously not valid
+	rec, err := fetchActivation(s.Storage.Activations, token)
 	if err != nil {
 		return http.StatusNotFound, "Token not valid"
 	}
 
-	// We've found a record for this token, so let's create an ApiKey instance
-	// with it
-	apiKey := ApiKey{}
-	// TODO: Handle error?
-	json.Unmarshal(data, &apiKey)
-
-	// Fetch the account for the given email address if there is one
-	acc, err := FetchAuthAccount(apiKey.Email, authDB)
-
-	if err != nil && err != leveldb.ErrNotFound {
-		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+	apiKey := rec.ApiKey
+	if rec.KeyTTL > 0 {
+		apiKey.ExpiresAt = time.Now().Add(rec.KeyTTL)
 	}
 
-	// If an account for this email address, doesn't exist yet, create one
-	if err == leveldb.ErrNotFound {
-		acc = AuthAccount{}
-		acc.Email = apiKey.Email
+	// Add the new key to the account (keys with the same device name will
+	// be replaced), creating the account first if this is its first key.
+	// updateAuthAccount retries under contention instead of blindly
+	// overwriting a concurrent change, e.g. another device activating at
+	// the same time
+	_, err = updateAuthAccount(s.Storage.Accounts, apiKey.Email, func(acc *AuthAccount) error {
+		acc.SetKey(apiKey)
+		return nil
+	})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
 	}
 
-	// Add the new key to the account (keys with the same device name will be replaced)
-	acc.SetKey(apiKey)
-
-	// Save the changes
-	err = SaveAuthAccount(acc, authDB)
-
 	// Remove the entry for this token
-	err = actDB.Delete([]byte(token), nil)
+	err = deleteActivation(s.Storage.Activations, token)
 
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
 	}
 
+	keyActivationsTotal.Inc()
+
 	return http.StatusOK, fmt.Sprintf("The api key for the device %s has been activated!", apiKey.DeviceName)
 }
 
-// Handler function for retrieving the data associated with a given account
-func GetData(acc AuthAccount, db *DataDB) (int, string) {
-	data, err := db.Get([]byte(acc.Email), nil)
+// Handler function for retrieving the data associated with a given account.
+// The current revision is returned in the ETag header so clients can make
+// a conditional PUT later
+func (s *Server) GetData(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	acc := accountFromContext(req)
+	env, err := getEnvelope(s.Storage.Data, acc.Email)
 
 	// There is no data for this account yet.
 	// TODO: Return empty response instead of NOT FOUND
-	if err == leveldb.ErrNotFound {
+	if err == ErrNotFound {
 		return http.StatusNotFound, "Could not find data for " + acc.Email
 	}
 
@@ -307,63 +419,242 @@ func GetData(acc AuthAccount, db *DataDB) (int, string) {
 		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
 	}
 
-	return http.StatusOK, string(data)
+	w.Header().Set("ETag", strconv.FormatUint(env.Revision, 10))
+	dataReadsTotal.Inc()
+
+	return http.StatusOK, string(env.Body)
 }
 
-// Handler function for updating the data associated with a given account
-func PutData(acc AuthAccount, data RequestBody, db *DataDB) (int, string) {
-	err := db.Put([]byte(acc.Email), data, nil)
+// Handler function for updating the data associated with a given account.
+// If an If-Match header is present, the update is only applied if it names
+// the revision currently stored; otherwise the request is rejected with
+// 409 Conflict and the current revision, so the client can merge and retry
+func (s *Server) PutData(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	acc := accountFromContext(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("An error occured while reading the request body: %s", err)
+	}
+
+	current, err := getEnvelope(s.Storage.Data, acc.Email)
+	hadCurrent := true
+
+	if err == ErrNotFound {
+		current = dataEnvelope{}
+		hadCurrent = false
+	} else if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+	}
+
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		want, parseErr := strconv.ParseUint(ifMatch, 10, 64)
+		if parseErr != nil || want != current.Revision {
+			w.Header().Set("ETag", strconv.FormatUint(current.Revision, 10))
+			return http.StatusConflict, fmt.Sprintf(`{"revision":%d}`, current.Revision)
+		}
+	}
+
+	next, ok, err := recordRevision(s.Storage.Data, acc.Email, body, current, hadCurrent)
 
 	if err != nil {
 		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
 	}
 
+	if !ok {
+		// Someone else advanced the revision between our read and our
+		// write; report the conflict instead of silently clobbering it
+		latest, err := getEnvelope(s.Storage.Data, acc.Email)
+		if err != nil && err != ErrNotFound {
+			return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+		}
+		w.Header().Set("ETag", strconv.FormatUint(latest.Revision, 10))
+		return http.StatusConflict, fmt.Sprintf(`{"revision":%d}`, latest.Revision)
+	}
+
+	w.Header().Set("ETag", strconv.FormatUint(next.Revision, 10))
+	dataWritesTotal.Inc()
+
+	return http.StatusOK, string(body)
+}
+
+// Handler function for listing the revisions retained for an account's
+// data, most recent first
+func (s *Server) ListHistory(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	acc := accountFromContext(req)
+
+	type revInfo struct {
+		Revision  uint64    `json:"revision"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	env, err := getEnvelope(s.Storage.Data, acc.Email)
+	if err == ErrNotFound {
+		return http.StatusOK, "[]"
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+	}
+
+	revisions := []revInfo{{Revision: env.Revision, UpdatedAt: env.UpdatedAt}}
+
+	for _, rev := range env.History {
+		entry, err := getHistoryEntry(s.Storage.Data, acc.Email, rev)
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, revInfo{Revision: entry.Revision, UpdatedAt: entry.UpdatedAt})
+	}
+
+	data, err := json.Marshal(revisions)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Failed to serialize history: %s", err)
+	}
+
 	return http.StatusOK, string(data)
 }
 
-func main() {
-	if dbPath == "" {
-		dbPath = "/var/lib/padlock"
+// Handler function for retrieving a specific prior revision of an
+// account's data
+func (s *Server) GetHistoryRevision(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	acc := accountFromContext(req)
+
+	rev, err := strconv.ParseUint(ps.ByName("rev"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, "Invalid revision"
 	}
 
-	// Open databases
-	ddb, err := leveldb.OpenFile(dbPath+"/data", nil)
-	adb, err := leveldb.OpenFile(dbPath+"/auth", nil)
-	acdb, err := leveldb.OpenFile(dbPath+"/act", nil)
+	if env, err := getEnvelope(s.Storage.Data, acc.Email); err == nil && env.Revision == rev {
+		return http.StatusOK, string(env.Body)
+	}
 
+	entry, err := getHistoryEntry(s.Storage.Data, acc.Email, rev)
 	if err != nil {
-		panic("Failed to open database!")
+		return http.StatusNotFound, fmt.Sprintf("No revision %d found for %s", rev, acc.Email)
 	}
 
-	defer ddb.Close()
-	defer adb.Close()
-	defer acdb.Close()
+	return http.StatusOK, string(entry.Body)
+}
 
-	// Create new martini web server instance
-	m := martini.Classic()
+// Handler function for listing the api keys registered to an account. The raw
+// key value is never included in the response, only metadata about each key
+func (s *Server) ListApiKeys(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	acc := accountFromContext(req)
+
+	type keyInfo struct {
+		DeviceName string    `json:"device_name"`
+		Scopes     []string  `json:"scopes,omitempty"`
+		CreatedAt  time.Time `json:"created_at,omitempty"`
+		LastUsedAt time.Time `json:"last_used_at,omitempty"`
+		ExpiresAt  time.Time `json:"expires_at,omitempty"`
+	}
+
+	keys := make([]keyInfo, len(acc.ApiKeys))
+	for i, apiKey := range acc.ApiKeys {
+		keys[i] = keyInfo{
+			DeviceName: apiKey.DeviceName,
+			Scopes:     apiKey.Scopes,
+			CreatedAt:  apiKey.CreatedAt,
+			LastUsedAt: apiKey.LastUsedAt,
+			ExpiresAt:  apiKey.ExpiresAt,
+		}
+	}
+
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Failed to serialize keys: %s", err)
+	}
+
+	return http.StatusOK, string(data)
+}
+
+// Handler function for revoking the api key registered for a given device name
+func (s *Server) RevokeApiKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	email := accountFromContext(req).Email
+	deviceName := ps.ByName("device_name")
+
+	_, err := updateAuthAccount(s.Storage.Accounts, email, func(acc *AuthAccount) error {
+		if acc.KeyForDevice(deviceName) == nil {
+			return errKeyNotFound
+		}
+		acc.RemoveKeyForDevice(deviceName)
+		return nil
+	})
+
+	if err == errKeyNotFound {
+		return http.StatusNotFound, fmt.Sprintf("No api key found for device %s", deviceName)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+	}
 
-	// Wrap datbases into different types so we can map them
-	dataDB := &DataDB{ddb}
-	authDB := &AuthDB{adb}
-	actDB := &ActDB{acdb}
+	return http.StatusOK, fmt.Sprintf("The api key for device %s has been revoked", deviceName)
+}
 
-	// Map databases so they can be injected into handlers
-	m.Map(dataDB)
-	m.Map(authDB)
-	m.Map(actDB)
+// Handler function for rotating the api key registered for a given device name.
+// The key keeps its device name and scopes but is assigned a fresh key value
+func (s *Server) RotateApiKey(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (int, string) {
+	email := accountFromContext(req).Email
+	deviceName := ps.ByName("device_name")
+
+	var rotated ApiKey
+	_, err := updateAuthAccount(s.Storage.Accounts, email, func(acc *AuthAccount) error {
+		apiKey := acc.KeyForDevice(deviceName)
+		if apiKey == nil {
+			return errKeyNotFound
+		}
 
-	m.Post("/auth", RequestApiKey)
+		apiKey.Key = uuid()
+		apiKey.CreatedAt = time.Now()
+		apiKey.LastUsedAt = time.Time{}
+		acc.SetKey(*apiKey)
+		rotated = *apiKey
+		return nil
+	})
 
-	m.Get("/activate/:token", ActivateApiKey)
+	if err == errKeyNotFound {
+		return http.StatusNotFound, fmt.Sprintf("No api key found for device %s", deviceName)
+	}
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Database error: %s", err)
+	}
 
-	// m.Get("/:email", func(params martini.Params, db *AuthDB) (int, string) {
-	// 	accData, _ := db.Get([]byte(params["email"]), nil)
-	// 	return 200, string(accData)
-	// })
+	data, err := json.Marshal(rotated)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Sprintf("Failed to serialize key: %s", err)
+	}
 
-	m.Get("/", Auth, GetData)
+	return http.StatusOK, string(data)
+}
+
+// Router builds the http.Handler serving every route, with each handler
+// wrapped for request-id tagging, structured logging and metrics
+func (s *Server) Router() http.Handler {
+	r := httprouter.New()
+
+	r.POST("/auth", s.wrap("/auth", s.rateLimitKeyRequest(s.RequestApiKey)))
+	r.GET("/activate/:token", s.wrap("/activate/:token", s.rateLimitActivate(s.ActivateApiKey)))
+
+	r.GET("/auth", s.wrap("/auth", s.Auth(ScopeKeysManage, s.ListApiKeys)))
+	r.DELETE("/auth/:device_name", s.wrap("/auth/:device_name", s.Auth(ScopeKeysManage, s.RevokeApiKey)))
+	r.POST("/auth/:device_name/rotate", s.wrap("/auth/:device_name/rotate", s.Auth(ScopeKeysManage, s.RotateApiKey)))
+
+	r.GET("/", s.wrap("/", s.Auth(ScopeDataRead, s.GetData)))
+	r.PUT("/", s.wrap("/", s.Auth(ScopeDataWrite, s.PutData)))
 
-	m.Put("/", Auth, InjectBody, PutData)
+	r.GET("/history", s.wrap("/history", s.Auth(ScopeDataRead, s.ListHistory)))
+	r.GET("/history/:rev", s.wrap("/history/:rev", s.Auth(ScopeDataRead, s.GetHistoryRevision)))
 
-	m.Run()
+	r.GET("/healthz", s.Healthz)
+	r.Handler("GET", "/metrics", metricsHandler())
+
+	return r
+}
+
+// Healthz is a liveness probe for the process itself; it doesn't touch
+// storage, so it stays up even if a backend is degraded
+func (s *Server) Healthz(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, `{"status":"ok"}`)
 }
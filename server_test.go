@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func newTestServer() *Server {
+	return &Server{
+		Storage: &Storage{
+			Accounts:    newFakeAccountStore(),
+			Data:        newFakeDataStore(),
+			Activations: newFakeActivationStore(),
+		},
+		Sender: &NoopSender{},
+	}
+}
+
+func requestApiKey(s *Server, form url.Values) (int, string) {
+	req := httptest.NewRequest("POST", "/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.RequestApiKey(httptest.NewRecorder(), req, nil)
+}
+
+func TestRequestApiKeyDefaultsToNeverExpiring(t *testing.T) {
+	status, body := requestApiKey(newTestServer(), url.Values{
+		"email":       {"a@b.com"},
+		"device_name": {"phone"},
+	})
+	if status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+
+	var apiKey ApiKey
+	if err := json.Unmarshal([]byte(body), &apiKey); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if !apiKey.ExpiresAt.IsZero() {
+		t.Fatalf("expected no expiry by default, got %v", apiKey.ExpiresAt)
+	}
+}
+
+func TestRequestApiKeyHonorsExpiresIn(t *testing.T) {
+	status, body := requestApiKey(newTestServer(), url.Values{
+		"email":       {"a@b.com"},
+		"device_name": {"phone"},
+		"expires_in":  {"1h"},
+	})
+	if status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+
+	// The TTL isn't applied to ExpiresAt until activation (see
+	// TestActivateApiKeyAppliesExpiresInFromActivationTime), so the
+	// pending key reported here still carries a zero ExpiresAt
+	var apiKey ApiKey
+	if err := json.Unmarshal([]byte(body), &apiKey); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if !apiKey.ExpiresAt.IsZero() {
+		t.Fatalf("expected ExpiresAt to stay zero until activation, got %v", apiKey.ExpiresAt)
+	}
+}
+
+// TestActivateApiKeyAppliesExpiresInFromActivationTime guards against
+// expires_in being baked into ExpiresAt at request time, which would let
+// a key expire before its activation link is ever clicked
+func TestActivateApiKeyAppliesExpiresInFromActivationTime(t *testing.T) {
+	s := newTestServer()
+
+	token := "test-token"
+	apiKey := ApiKey{Email: "a@b.com", DeviceName: "phone", Key: "test-key", CreatedAt: time.Now()}
+	if err := storeActivation(s.Storage.Activations, token, apiKey, time.Hour); err != nil {
+		t.Fatalf("failed to store activation: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/activate/"+token, nil)
+	ps := httprouter.Params{{Key: "token", Value: token}}
+	status, body := s.ActivateApiKey(httptest.NewRecorder(), req, ps)
+	if status != 200 {
+		t.Fatalf("expected 200, got %d: %s", status, body)
+	}
+
+	acc, err := s.Storage.Accounts.Get("a@b.com")
+	if err != nil {
+		t.Fatalf("failed to fetch account: %v", err)
+	}
+	activated := acc.KeyForDevice("phone")
+	if activated == nil {
+		t.Fatal("expected the activated key to be registered on the account")
+	}
+	if activated.ExpiresAt.IsZero() {
+		t.Fatal("expected activation to set a non-zero ExpiresAt")
+	}
+	if activated.Expired() {
+		t.Fatalf("expected ExpiresAt an hour out, got %v", activated.ExpiresAt)
+	}
+}
+
+func TestRequestApiKeyRejectsInvalidExpiresIn(t *testing.T) {
+	status, _ := requestApiKey(newTestServer(), url.Values{
+		"email":       {"a@b.com"},
+		"device_name": {"phone"},
+		"expires_in":  {"not-a-duration"},
+	})
+	if status != 400 {
+		t.Fatalf("expected 400 for a malformed expires_in, got %d", status)
+	}
+}
+
+func TestRequestApiKeyRejectsNonPositiveExpiresIn(t *testing.T) {
+	status, _ := requestApiKey(newTestServer(), url.Values{
+		"email":       {"a@b.com"},
+		"device_name": {"phone"},
+		"expires_in":  {"-1h"},
+	})
+	if status != 400 {
+		t.Fatalf("expected 400 for a non-positive expires_in, got %d", status)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrNotFound is returned by storage implementations when a requested
+// record does not exist, regardless of which backend is in use
+var ErrNotFound = errors.New("padlock: record not found")
+
+// AccountStore persists AuthAccount records, keyed by email address
+type AccountStore interface {
+	Get(email string) (AuthAccount, error)
+	Put(acc AuthAccount) error
+	// PutIfVersion atomically stores acc, but only if the account
+	// currently stored for acc.Email has the given version (or nothing is
+	// stored yet and version is 0). It reports whether the write was
+	// applied; a false result with a nil error means a concurrent writer
+	// updated the account first and the caller should re-fetch and retry
+	PutIfVersion(acc AuthAccount, version uint64) (bool, error)
+}
+
+// DataStore persists the opaque data blob associated with an account,
+// keyed by email address. It's also used, with suffixed keys, to keep the
+// rolling revision history described in data.go
+type DataStore interface {
+	Get(email string) ([]byte, error)
+	Put(email string, data []byte) error
+	Delete(email string) error
+	// PutIfRevision atomically stores data under email, but only if the
+	// envelope currently stored for email has the given revision (or
+	// nothing is stored yet and expectedRevision is 0). It reports whether
+	// the write was applied; a false result with a nil error means a
+	// concurrent writer advanced the revision first and the caller should
+	// re-fetch and retry or report a conflict
+	PutIfRevision(email string, expectedRevision uint64, data []byte) (bool, error)
+}
+
+// ActivationStore persists pending api key activation records, keyed by
+// the activation token
+type ActivationStore interface {
+	Get(token string) ([]byte, error)
+	Put(token string, data []byte) error
+	Delete(token string) error
+	// ForEach visits every record in the store, e.g. so expired ones can
+	// be swept. Iteration stops at the first error fn returns
+	ForEach(fn func(key string, data []byte) error) error
+}
+
+// Storage bundles the stores the server needs to run and the means to
+// shut them down cleanly
+type Storage struct {
+	Accounts    AccountStore
+	Data        DataStore
+	Activations ActivationStore
+	closer      func() error
+}
+
+// Close releases any resources (open files, connections, ...) held by the
+// underlying backend
+func (s *Storage) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer()
+}
+
+// NewStorage picks a storage backend based on the PADLOCK_STORAGE env var
+// ("leveldb", the default, or "sql") and opens it. For the "sql" backend,
+// PADLOCK_SQL_DRIVER (e.g. "sqlite3", "postgres") and PADLOCK_STORAGE_DSN
+// select the driver and data source. The sql backend requires building
+// with "-tags sql" (it pulls in the cgo-based mattn/go-sqlite3 driver);
+// without that tag, PADLOCK_STORAGE=sql fails at runtime instead of
+// forcing every build to need a C toolchain
+func NewStorage() (*Storage, error) {
+	switch backend := os.Getenv("PADLOCK_STORAGE"); backend {
+	case "", "leveldb":
+		path := dbPath
+		if path == "" {
+			path = "/var/lib/padlock"
+		}
+		return NewLevelDBStorage(path)
+	case "sql":
+		driver := os.Getenv("PADLOCK_SQL_DRIVER")
+		if driver == "" {
+			driver = "sqlite3"
+		}
+		return NewSQLStorage(driver, os.Getenv("PADLOCK_STORAGE_DSN"))
+	default:
+		return nil, fmt.Errorf("padlock: unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// keyMutex hands out a *sync.Mutex per key, creating one lazily the first
+// time it's seen. leveldb has no cross-call transactions, so the
+// PutIfVersion/PutIfRevision compare-and-swap methods below lock the
+// relevant key for the duration of their read-modify-write instead
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func newKeyMutex() *keyMutex {
+	return &keyMutex{locks: make(map[string]*sync.Mutex)}
+}
+
+// Lock blocks until key is free, then returns a function that releases it
+func (m *keyMutex) Lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[key] = l
+	}
+	m.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// levelDBAccountStore implements AccountStore on top of a leveldb.DB
+type levelDBAccountStore struct {
+	db    *leveldb.DB
+	locks *keyMutex
+}
+
+func (s *levelDBAccountStore) Get(email string) (AuthAccount, error) {
+	acc := AuthAccount{}
+	data, err := s.db.Get([]byte(email), nil)
+	if err == leveldb.ErrNotFound {
+		return acc, ErrNotFound
+	}
+	if err != nil {
+		return acc, err
+	}
+	return acc, json.Unmarshal(data, &acc)
+}
+
+func (s *levelDBAccountStore) Put(acc AuthAccount) error {
+	data, err := json.Marshal(acc)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(acc.Email), data, nil)
+}
+
+// PutIfVersion implements the compare-and-swap SaveAuthAccount relies on:
+// it only writes acc if the account currently stored for acc.Email still
+// has the given version, locking acc.Email for the duration of the
+// read-modify-write so two concurrent callers can't both succeed
+func (s *levelDBAccountStore) PutIfVersion(acc AuthAccount, version uint64) (bool, error) {
+	unlock := s.locks.Lock(acc.Email)
+	defer unlock()
+
+	current, err := s.Get(acc.Email)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+
+	if current.Version != version {
+		return false, nil
+	}
+
+	data, err := json.Marshal(acc)
+	if err != nil {
+		return false, err
+	}
+
+	return true, s.db.Put([]byte(acc.Email), data, nil)
+}
+
+// levelDBDataStore implements DataStore on top of a leveldb.DB
+type levelDBDataStore struct {
+	db    *leveldb.DB
+	locks *keyMutex
+}
+
+func (s *levelDBDataStore) Get(email string) ([]byte, error) {
+	data, err := s.db.Get([]byte(email), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *levelDBDataStore) Put(email string, data []byte) error {
+	return s.db.Put([]byte(email), data, nil)
+}
+
+func (s *levelDBDataStore) Delete(email string) error {
+	return s.db.Delete([]byte(email), nil)
+}
+
+// PutIfRevision implements the compare-and-swap recordRevision relies on:
+// it only writes data if the envelope currently stored for email still has
+// revision expectedRevision, locking email for the duration of the
+// read-modify-write so two concurrent callers can't both succeed for the
+// same revision
+func (s *levelDBDataStore) PutIfRevision(email string, expectedRevision uint64, data []byte) (bool, error) {
+	unlock := s.locks.Lock(email)
+	defer unlock()
+
+	current, err := s.Get(email)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+
+	var env dataEnvelope
+	if err == nil {
+		if err := json.Unmarshal(current, &env); err != nil {
+			return false, err
+		}
+	}
+
+	if env.Revision != expectedRevision {
+		return false, nil
+	}
+
+	return true, s.db.Put([]byte(email), data, nil)
+}
+
+// levelDBActivationStore implements ActivationStore on top of a leveldb.DB
+type levelDBActivationStore struct {
+	db *leveldb.DB
+}
+
+func (s *levelDBActivationStore) Get(token string) ([]byte, error) {
+	data, err := s.db.Get([]byte(token), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *levelDBActivationStore) Put(token string, data []byte) error {
+	return s.db.Put([]byte(token), data, nil)
+}
+
+func (s *levelDBActivationStore) Delete(token string) error {
+	return s.db.Delete([]byte(token), nil)
+}
+
+func (s *levelDBActivationStore) ForEach(fn func(key string, data []byte) error) error {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := string(iter.Key())
+		data := append([]byte(nil), iter.Value()...)
+		if err := fn(key, data); err != nil {
+			return err
+		}
+	}
+
+	return iter.Error()
+}
+
+// NewLevelDBStorage opens the three leveldb databases rooted at path (one
+// directory per store, as before) and wraps them as a Storage
+func NewLevelDBStorage(path string) (*Storage, error) {
+	ddb, err := leveldb.OpenFile(path+"/data", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	adb, err := leveldb.OpenFile(path+"/auth", nil)
+	if err != nil {
+		ddb.Close()
+		return nil, err
+	}
+
+	acdb, err := leveldb.OpenFile(path+"/act", nil)
+	if err != nil {
+		ddb.Close()
+		adb.Close()
+		return nil, err
+	}
+
+	return &Storage{
+		Accounts:    &levelDBAccountStore{db: adb, locks: newKeyMutex()},
+		Data:        &levelDBDataStore{db: ddb, locks: newKeyMutex()},
+		Activations: &levelDBActivationStore{acdb},
+		closer: func() error {
+			ddb.Close()
+			adb.Close()
+			acdb.Close()
+			return nil
+		},
+	}, nil
+}
@@ -0,0 +1,234 @@
+// This file pulls in github.com/mattn/go-sqlite3, which is cgo-based and
+// needs a C toolchain to build. It's gated behind the "sql" build tag so
+// the default build (leveldb only) stays cgo-free; pass "-tags sql" to
+// enable PADLOCK_STORAGE=sql. See storage_sql_stub.go for the fallback
+// NewSQLStorage used when this tag isn't set
+
+//go:build sql
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	// Drivers registered here are available to NewSQLStorage via the
+	// PADLOCK_SQL_DRIVER env var
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlAccountStore implements AccountStore on top of a database/sql
+// connection, storing each account as a single JSON blob
+type sqlAccountStore struct {
+	db *sql.DB
+}
+
+func (s *sqlAccountStore) Get(email string) (AuthAccount, error) {
+	acc := AuthAccount{}
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM accounts WHERE email = $1", email).Scan(&data)
+	if err == sql.ErrNoRows {
+		return acc, ErrNotFound
+	}
+	if err != nil {
+		return acc, err
+	}
+	return acc, json.Unmarshal(data, &acc)
+}
+
+func (s *sqlAccountStore) Put(acc AuthAccount) error {
+	data, err := json.Marshal(acc)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO accounts (email, data, version) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (email) DO UPDATE SET data = $2, version = $3",
+		acc.Email, data, acc.Version,
+	)
+	return err
+}
+
+// PutIfVersion implements the compare-and-swap acc.Version expects: a
+// brand new account (version 0) is only inserted if the email isn't
+// already taken, and an existing account is only updated if its stored
+// version still matches version
+func (s *sqlAccountStore) PutIfVersion(acc AuthAccount, version uint64) (bool, error) {
+	data, err := json.Marshal(acc)
+	if err != nil {
+		return false, err
+	}
+
+	var res sql.Result
+	if version == 0 {
+		res, err = s.db.Exec(
+			"INSERT INTO accounts (email, data, version) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (email) DO NOTHING",
+			acc.Email, data, acc.Version,
+		)
+	} else {
+		// Placeholders are numbered in Go-argument order, not query-text
+		// position: the sqlite3 driver binds by left-to-right occurrence
+		// rather than by the $N numeral, so anything else silently binds
+		// the wrong values (this also happens to be valid for Postgres,
+		// which binds by number)
+		res, err = s.db.Exec(
+			"UPDATE accounts SET data = $1, version = $2 WHERE email = $3 AND version = $4",
+			data, acc.Version, acc.Email, version,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// sqlDataStore implements DataStore on top of a database/sql connection
+type sqlDataStore struct {
+	db *sql.DB
+}
+
+func (s *sqlDataStore) Get(email string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM data WHERE email = $1", email).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *sqlDataStore) Put(email string, data []byte) error {
+	_, err := s.db.Exec(
+		"INSERT INTO data (email, data) VALUES ($1, $2) "+
+			"ON CONFLICT (email) DO UPDATE SET data = $2",
+		email, data,
+	)
+	return err
+}
+
+func (s *sqlDataStore) Delete(email string) error {
+	_, err := s.db.Exec("DELETE FROM data WHERE email = $1", email)
+	return err
+}
+
+// PutIfRevision implements the compare-and-swap recordRevision relies on:
+// the first envelope for email (expectedRevision 0) is only inserted if
+// the email doesn't already have one, and a later envelope is only
+// written if the stored revision still matches expectedRevision
+func (s *sqlDataStore) PutIfRevision(email string, expectedRevision uint64, data []byte) (bool, error) {
+	var res sql.Result
+	var err error
+
+	if expectedRevision == 0 {
+		res, err = s.db.Exec(
+			"INSERT INTO data (email, data, revision) VALUES ($1, $2, $3) "+
+				"ON CONFLICT (email) DO NOTHING",
+			email, data, expectedRevision+1,
+		)
+	} else {
+		// See the comment on sqlAccountStore.PutIfVersion: placeholders
+		// must be numbered in Go-argument order for sqlite3 to bind them
+		// correctly, not just in query-text position
+		res, err = s.db.Exec(
+			"UPDATE data SET data = $1, revision = $2 WHERE email = $3 AND revision = $4",
+			data, expectedRevision+1, email, expectedRevision,
+		)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// sqlActivationStore implements ActivationStore on top of a database/sql
+// connection
+type sqlActivationStore struct {
+	db *sql.DB
+}
+
+func (s *sqlActivationStore) Get(token string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM activations WHERE token = $1", token).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *sqlActivationStore) Put(token string, data []byte) error {
+	_, err := s.db.Exec(
+		"INSERT INTO activations (token, data) VALUES ($1, $2) "+
+			"ON CONFLICT (token) DO UPDATE SET data = $2",
+		token, data,
+	)
+	return err
+}
+
+func (s *sqlActivationStore) Delete(token string) error {
+	_, err := s.db.Exec("DELETE FROM activations WHERE token = $1", token)
+	return err
+}
+
+func (s *sqlActivationStore) ForEach(fn func(key string, data []byte) error) error {
+	rows, err := s.db.Query("SELECT token, data FROM activations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		var data []byte
+		if err := rows.Scan(&token, &data); err != nil {
+			return err
+		}
+		if err := fn(token, data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// sqlSchema creates the tables the stores above rely on, if they don't
+// already exist. It sticks to types/syntax that both SQLite and Postgres
+// understand
+var sqlSchema = []string{
+	"CREATE TABLE IF NOT EXISTS accounts (email TEXT PRIMARY KEY, data BLOB NOT NULL, version INTEGER NOT NULL DEFAULT 0)",
+	"CREATE TABLE IF NOT EXISTS data (email TEXT PRIMARY KEY, data BLOB NOT NULL, revision INTEGER NOT NULL DEFAULT 0)",
+	"CREATE TABLE IF NOT EXISTS activations (token TEXT PRIMARY KEY, data BLOB NOT NULL)",
+}
+
+// NewSQLStorage opens a database/sql connection for the given driver
+// ("sqlite3", "postgres", ...) and DSN, creates the schema if necessary,
+// and wraps it as a Storage
+func NewSQLStorage(driver string, dsn string) (*Storage, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, stmt := range sqlSchema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &Storage{
+		Accounts:    &sqlAccountStore{db},
+		Data:        &sqlDataStore{db},
+		Activations: &sqlActivationStore{db},
+		closer:      db.Close,
+	}, nil
+}
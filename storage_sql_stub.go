@@ -0,0 +1,15 @@
+// This is the fallback used when the "sql" build tag isn't set (see
+// storage_sql.go), so the default, cgo-free build can still reference
+// NewSQLStorage without pulling in the cgo-based mattn/go-sqlite3 driver
+
+//go:build !sql
+
+package main
+
+import "fmt"
+
+// NewSQLStorage is unavailable in this build; rebuild with "-tags sql" to
+// enable PADLOCK_STORAGE=sql
+func NewSQLStorage(driver string, dsn string) (*Storage, error) {
+	return nil, fmt.Errorf("padlock: built without sql backend support; rebuild with -tags sql")
+}
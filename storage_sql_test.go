@@ -0,0 +1,70 @@
+//go:build sql
+
+package main
+
+import "testing"
+
+// newTestSQLStorage opens an in-memory sqlite3-backed Storage. It exercises
+// the real sqlAccountStore/sqlDataStore CAS queries against the real driver,
+// since a stub would hide the placeholder-ordering bug these tests guard
+// against (see the comments on PutIfVersion/PutIfRevision in storage_sql.go)
+func newTestSQLStorage(t *testing.T) *Storage {
+	t.Helper()
+
+	s, err := NewSQLStorage("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open in-memory sqlite3 storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSQLAccountStorePutIfVersionUpdatesOnMatchingVersion(t *testing.T) {
+	s := newTestSQLStorage(t).Accounts
+
+	// As SaveAuthAccount does: a brand new account is stored with
+	// Version 1, expecting version 0 (nothing stored yet)
+	acc := AuthAccount{Email: "a@b.com", Version: 1}
+	ok, err := s.PutIfVersion(acc, 0)
+	if err != nil || !ok {
+		t.Fatalf("expected initial insert to succeed, got ok=%v err=%v", ok, err)
+	}
+
+	// A write expecting the version the insert left behind must also
+	// succeed; if the CAS UPDATE's placeholders are misnumbered, this
+	// comes back ok=false against the real sqlite3 driver even though
+	// nothing else is contending for the row
+	acc.Version = 2
+	ok, err = s.PutIfVersion(acc, 1)
+	if err != nil || !ok {
+		t.Fatalf("expected update at matching version to succeed, got ok=%v err=%v", ok, err)
+	}
+
+	// A write against a stale expected version must still be rejected
+	acc.Version = 3
+	ok, err = s.PutIfVersion(acc, 1)
+	if err != nil || ok {
+		t.Fatalf("expected update at stale version to be rejected, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestSQLDataStorePutIfRevisionUpdatesOnMatchingRevision(t *testing.T) {
+	s := newTestSQLStorage(t).Data
+
+	ok, err := s.PutIfRevision("a@b.com", 0, []byte("v1"))
+	if err != nil || !ok {
+		t.Fatalf("expected initial insert to succeed, got ok=%v err=%v", ok, err)
+	}
+
+	// As above: a matching-revision update must succeed against the real
+	// driver, not just the fake used elsewhere in the test suite
+	ok, err = s.PutIfRevision("a@b.com", 1, []byte("v2"))
+	if err != nil || !ok {
+		t.Fatalf("expected update at matching revision to succeed, got ok=%v err=%v", ok, err)
+	}
+
+	ok, err = s.PutIfRevision("a@b.com", 1, []byte("v3"))
+	if err != nil || ok {
+		t.Fatalf("expected update at stale revision to be rejected, got ok=%v err=%v", ok, err)
+	}
+}